@@ -0,0 +1,106 @@
+// clientauth.go - Onion Service client authorization helpers.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to onionwrap, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// clientAuthArgList is a repeatable '-client-auth' flag, collected in the
+// order given on the command line.
+type clientAuthArgList []string
+
+func (c *clientAuthArgList) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *clientAuthArgList) Set(v string) error {
+	*c = append(*c, v)
+	return nil
+}
+
+// pendingV3ClientAuthWrite is a generated v3 client authorization keypair
+// whose private half still needs to be written to disk, once the
+// ServiceID it's serialized alongside is known.
+type pendingV3ClientAuthWrite struct {
+	name    string
+	privKey [32]byte
+}
+
+// clientAuthEntry is a single parsed '-client-auth' argument.
+type clientAuthEntry struct {
+	name string
+
+	// pubKey holds the v3 base32 x25519 public key, or the v2 BasicAuth
+	// cookie, if one was supplied on the command line.  It is empty when
+	// onionwrap is expected to generate/obtain one itself.
+	pubKey string
+}
+
+// parseClientAuthArg parses a single '-client-auth' argument of the form
+// 'NAME[:PUBKEY]'.
+func parseClientAuthArg(arg string) (clientAuthEntry, error) {
+	if arg == "" {
+		return clientAuthEntry{}, errors.New("empty -client-auth argument")
+	}
+	splitArg := strings.SplitN(arg, ":", 2)
+	if splitArg[0] == "" {
+		return clientAuthEntry{}, errors.New("missing NAME in -client-auth argument")
+	}
+	e := clientAuthEntry{name: splitArg[0]}
+	if len(splitArg) == 2 {
+		e.pubKey = splitArg[1]
+	}
+	return e, nil
+}
+
+// generateV3ClientAuthKey generates a new x25519 keypair for use with a
+// 'ClientAuthV3' clause.
+func generateV3ClientAuthKey() (pubKey, privKey [32]byte, err error) {
+	if _, err = rand.Read(privKey[:]); err != nil {
+		return pubKey, privKey, err
+	}
+	pub, err := curve25519.X25519(privKey[:], curve25519.Basepoint)
+	if err != nil {
+		return pubKey, privKey, err
+	}
+	copy(pubKey[:], pub)
+	return pubKey, privKey, nil
+}
+
+func base32NoPad(b []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// writeV3ClientAuthFile serializes privKey into a client-side
+// '.auth_private' file, ready to be dropped into a Tor client's
+// 'ClientOnionAuthDir'.
+func writeV3ClientAuthFile(dir, name, serviceID string, privKey [32]byte) error {
+	if dir == "" {
+		return errors.New("-client-auth-dir must be set to save generated client keys")
+	}
+	content := serviceID + ":descriptor:x25519:" + base32NoPad(privKey[:]) + "\n"
+	return ioutil.WriteFile(filepath.Join(dir, name+".auth_private"), []byte(content), 0600)
+}
+
+// writeV2ClientAuthFile serializes a v2 BasicAuth cookie assigned by Tor
+// into a client-side '.auth_private' file.
+func writeV2ClientAuthFile(dir, name, cookie string) error {
+	if dir == "" {
+		return errors.New("-client-auth-dir must be set to save assigned client cookies")
+	}
+	content := name + ":" + cookie + "\n"
+	return ioutil.WriteFile(filepath.Join(dir, name+".auth_private"), []byte(content), 0600)
+}
@@ -8,33 +8,132 @@
 package main
 
 import (
+	"context"
 	"io"
 	"net"
+	"os"
 	"os/exec"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func runInetd(targetNet, targetAddr string, cmd *exec.Cmd) {
-	l, err := net.Listen(targetNet, targetAddr)
-	if err != nil {
-		errorf("Failed to create an inetd listener: %v\n", err)
-	}
-	defer l.Close()
+// listenerSpec identifies a single network/address pair that 'runInetd'
+// should listen on, corresponding to one '-port' mapping's target.
+type listenerSpec struct {
+	network  string
+	address  string
+	virtPort string
+}
 
-	for {
-		conn, err := l.Accept()
+// connMeta is the Tor-side metadata for a single accepted connection, handed
+// off to the spawned child via the environment.
+//
+// Note: there is intentionally no 'ONION_CLIENT_NAME' here.  Correlating an
+// inbound rendezvous with the '-client-auth' name that authorized it would
+// require tracking Tor's per-circuit/per-stream control port events, which
+// 'runInetd's simple accept-loop doesn't have a handle on; that's left for
+// if/when onionwrap grows real stream-level control port integration.
+type connMeta struct {
+	serviceID string
+	virtPort  string
+}
+
+// runInetd listens on each of specs, spawning cmd per accepted connection,
+// until ctx is cancelled.  On cancellation, the listeners are closed and
+// in-flight connections are given up to sigKillDelay to finish before
+// runInetd returns.  maxConns, if positive, bounds the number of connections
+// handled concurrently; connTimeout and passFD are forwarded to each
+// connection's handler.
+func runInetd(ctx context.Context, specs []listenerSpec, cmd *exec.Cmd, serviceID string, maxConns int, connTimeout time.Duration, passFD bool) {
+	listeners := make([]net.Listener, 0, len(specs))
+	for _, spec := range specs {
+		l, err := net.Listen(spec.network, spec.address)
 		if err != nil {
-			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				errorf("Critical Accept() failure: %v\n", err)
-			}
-			continue
+			errorf("Failed to create an inetd listener: %v\n", err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	go func() {
+		<-ctx.Done()
+		debugf("inetd: shutting down, closing listeners\n")
+		for _, l := range listeners {
+			l.Close()
 		}
-		debugf("inetd: new connection: %s\n", conn.RemoteAddr())
-		go onInetdConn(conn, cmd)
+	}()
+
+	// sem, when non-nil, bounds the number of connections handled at once,
+	// so that a flood of onion connections can't fork-bomb the host.
+	var sem chan struct{}
+	if maxConns > 0 {
+		sem = make(chan struct{}, maxConns)
+	}
+
+	var listenWG, connWG sync.WaitGroup
+	for i, l := range listeners {
+		listenWG.Add(1)
+		go func(l net.Listener, spec listenerSpec) {
+			defer listenWG.Done()
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					select {
+					case <-ctx.Done():
+						return
+					default:
+					}
+					if e, ok := err.(net.Error); ok && !e.Temporary() {
+						errorf("Critical Accept() failure: %v\n", err)
+					}
+					continue
+				}
+				debugf("inetd: new connection: %s\n", conn.RemoteAddr())
+
+				if sem != nil {
+					select {
+					case sem <- struct{}{}:
+					case <-ctx.Done():
+						conn.Close()
+						return
+					}
+				}
+				connWG.Add(1)
+				go func(conn net.Conn) {
+					defer connWG.Done()
+					if sem != nil {
+						defer func() { <-sem }()
+					}
+					meta := connMeta{serviceID: serviceID, virtPort: spec.virtPort}
+					onInetdConn(conn, cmd, meta, passFD, connTimeout)
+				}(conn)
+			}
+		}(l, specs[i])
+	}
+	listenWG.Wait()
+
+	connsDone := make(chan struct{})
+	go func() {
+		connWG.Wait()
+		close(connsDone)
+	}()
+	select {
+	case <-connsDone:
+	case <-time.After(sigKillDelay):
+		debugf("inetd: timed out waiting for in-flight connections to finish\n")
 	}
 }
 
-func onInetdConn(conn net.Conn, cmdProto *exec.Cmd) {
+// fileConn is implemented by *net.TCPConn and *net.UnixConn, and is used to
+// obtain a dup'd *os.File for '-pass-fd'.
+type fileConn interface {
+	File() (*os.File, error)
+}
+
+func onInetdConn(conn net.Conn, cmdProto *exec.Cmd, meta connMeta, passFD bool, connTimeout time.Duration) {
+	start := time.Now()
+	remoteAddr := conn.RemoteAddr().String()
 	defer conn.Close()
 
 	var cmd *exec.Cmd
@@ -43,54 +142,113 @@ func onInetdConn(conn net.Conn, cmdProto *exec.Cmd) {
 	} else {
 		cmd = exec.Command(cmdProto.Args[0])
 	}
+	cmd.Env = append(os.Environ(),
+		"ONION_REMOTE_ADDR="+remoteAddr,
+		"ONION_SERVICE_ID="+meta.serviceID,
+		"ONION_VIRTPORT="+meta.virtPort,
+	)
 
-	// Sigh, for some reason just setting cmd.Stdin/cmd.Stdout to
-	// conn doesn't result in closes getting propagated, so Run()
-	// doesn't appear to unblock, even when conn is closed.
-	//
-	// Do this the hard way.
+	var upBytes, downBytes int64
+	byteCountsKnown := !passFD
+	if passFD {
+		fc, ok := conn.(fileConn)
+		if !ok {
+			infof("inetd: -pass-fd: connection type does not support file descriptor passing\n")
+			return
+		}
+		f, err := fc.File()
+		if err != nil {
+			infof("inetd: -pass-fd: failed to obtain a file descriptor: %v\n", err)
+			return
+		}
+		defer f.Close()
+		cmd.ExtraFiles = []*os.File{f}
 
-	stdinPipe, err := cmd.StdinPipe()
-	if err != nil {
-		infof("inetd: Failed to create stdin pipe: %v\n", err)
-		return
-	}
-	defer stdinPipe.Close()
+		if err = cmd.Start(); err != nil {
+			infof("inetd: Failed to start command: %v\n", err)
+			return
+		}
+		cmd.Wait()
+	} else {
+		// Sigh, for some reason just setting cmd.Stdin/cmd.Stdout to
+		// conn doesn't result in closes getting propagated, so Run()
+		// doesn't appear to unblock, even when conn is closed.
+		//
+		// Do this the hard way.
+
+		var src io.ReadWriteCloser = conn
+		if connTimeout > 0 {
+			src = &idleTimeoutConn{Conn: conn, timeout: connTimeout}
+		}
+
+		stdinPipe, err := cmd.StdinPipe()
+		if err != nil {
+			infof("inetd: Failed to create stdin pipe: %v\n", err)
+			return
+		}
+		defer stdinPipe.Close()
 
-	stdoutPipe, err := cmd.StdoutPipe()
-	if err != nil {
-		infof("inetd: Failed to create stdout pipe: %v\n", err)
-		return
+		stdoutPipe, err := cmd.StdoutPipe()
+		if err != nil {
+			infof("inetd: Failed to create stdout pipe: %v\n", err)
+			return
+		}
+		defer stdoutPipe.Close()
+
+		if err = cmd.Start(); err != nil {
+			infof("inetd: Failed to start command: %v\n", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go copyLoop(&wg, src, stdinPipe, &upBytes)
+		go copyLoop(&wg, stdoutPipe, src, &downBytes)
+		wg.Wait()
+
+		cmd.Process.Kill()
+		cmd.Wait()
 	}
-	defer stdoutPipe.Close()
 
-	if err = cmd.Start(); err != nil {
-		infof("inetd: Failed to start command: %v\n", err)
-		return
+	upStr, downStr := strconv.FormatInt(upBytes, 10), strconv.FormatInt(downBytes, 10)
+	if !byteCountsKnown {
+		// '-pass-fd' hands the socket off to the child directly, so the
+		// bytes exchanged over it aren't observable here.
+		upStr, downStr = "-", "-"
 	}
+	infof("inetd: remote=%s service=%s vport=%s pid=%d up=%s down=%s duration=%v exit=%d\n",
+		remoteAddr, meta.serviceID, meta.virtPort, cmd.Process.Pid, upStr, downStr, time.Since(start), cmd.ProcessState.ExitCode())
+}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go copyLoop(&wg, conn, stdinPipe)
-	go copyLoop(&wg, stdoutPipe, conn)
-	wg.Wait()
+// idleTimeoutConn closes the underlying connection if no data is read or
+// written for longer than timeout, so that '-conn-timeout' can reap
+// connections whose client (or wrapped command) has gone idle.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
 
-	cmd.Process.Kill()
-	cmd.Wait()
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
 
-	debugf("inetd: closed connection: %s\n", conn.RemoteAddr())
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
 }
 
-func copyLoop(wg *sync.WaitGroup, src io.ReadCloser, dst io.WriteCloser) {
+func copyLoop(wg *sync.WaitGroup, src io.ReadCloser, dst io.WriteCloser, n *int64) {
 	defer src.Close()
 	defer dst.Close()
 	defer wg.Done()
 
 	var buf [1024]byte
 	for {
-		n, rdErr := src.Read(buf[:])
-		if n > 0 {
-			_, wrErr := dst.Write(buf[:n])
+		nr, rdErr := src.Read(buf[:])
+		if nr > 0 {
+			atomic.AddInt64(n, int64(nr))
+			_, wrErr := dst.Write(buf[:nr])
 			if wrErr != nil {
 				return
 			}
@@ -0,0 +1,213 @@
+// embedtor.go - Launch and manage an embedded 'tor' process.
+//
+// To the extent possible under law, Yawning Angel waived all copyright
+// and related or neighboring rights to onionwrap, using the creative
+// commons "cc0" public domain dedication. See LICENSE or
+// <http://creativecommons.org/publicdomain/zero/1.0/> for full details.
+
+// Package embedtor starts and manages a child 'tor' process, for use when
+// the caller doesn't already have one running with a reachable control
+// port.  The approach (write a throwaway torrc, pick a random
+// ControlPort, watch stdout for the bootstrap line) mirrors what
+// cretz/bine's 'tor' package does.
+package embedtor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yawning/bulb"
+)
+
+const (
+	torrcName           = "torrc"
+	cookieFileName      = "control_auth_cookie"
+	bootstrappedMarker  = "Bootstrapped 100%"
+	defaultBootstrapDur = 60 * time.Second
+)
+
+// Config holds the parameters used to launch an embedded 'tor' process.
+type Config struct {
+	// TorPath is the path to the 'tor' binary.  If empty, 'tor' is
+	// resolved via $PATH.
+	TorPath string
+
+	// BaseDataDir is the parent directory in which a fresh, randomly
+	// named 'DataDirectory' is created.  If empty, the OS default
+	// temporary directory is used.
+	BaseDataDir string
+
+	// BootstrapTimeout bounds how long to wait for 'tor' to reach
+	// 'Bootstrapped 100%' before giving up.  If zero, a default of 60
+	// seconds is used.
+	BootstrapTimeout time.Duration
+
+	// Stderr, if set, receives a copy of tor's stdout/stderr (its NOTICE
+	// log), e.g. for '-debug'.
+	Stderr io.Writer
+}
+
+// Tor is a running embedded 'tor' process, managed on the caller's behalf.
+type Tor struct {
+	cmd        *exec.Cmd
+	dataDir    string
+	ctrlNet    string
+	ctrlAddr   string
+	cookiePath string
+}
+
+// ControlAddr returns the network/address pair suitable for 'bulb.Dial'.
+func (t *Tor) ControlAddr() (network, addr string) {
+	return t.ctrlNet, t.ctrlAddr
+}
+
+// CookiePath returns the path to the 'CookieAuthentication' cookie file.
+func (t *Tor) CookiePath() string {
+	return t.cookiePath
+}
+
+// Shutdown asks the embedded 'tor' to terminate via ctrlConn's control
+// connection ('SIGNAL SHUTDOWN'), and failing a clean exit within
+// killDelay, kills the process outright.  The DataDirectory is always
+// removed.
+func (t *Tor) Shutdown(ctrlConn *bulb.Conn, killDelay time.Duration) error {
+	defer os.RemoveAll(t.dataDir)
+
+	if ctrlConn != nil {
+		ctrlConn.Request("SIGNAL SHUTDOWN")
+	}
+
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- t.cmd.Wait()
+	}()
+
+	select {
+	case err := <-doneChan:
+		return err
+	case <-time.After(killDelay):
+		t.cmd.Process.Kill()
+		<-doneChan
+		return errors.New("embedtor: tor did not shut down cleanly, killed")
+	}
+}
+
+// freePort asks the OS for a free TCP port on the loopback interface.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Launch starts a new 'tor' process per cfg, and blocks until it has
+// finished bootstrapping (or cfg.BootstrapTimeout elapses).
+func Launch(cfg Config) (*Tor, error) {
+	dataDir, err := ioutil.TempDir(cfg.BaseDataDir, "onionwrap-tor-")
+	if err != nil {
+		return nil, fmt.Errorf("embedtor: failed to create DataDirectory: %v", err)
+	}
+
+	ctrlPort, err := freePort()
+	if err != nil {
+		os.RemoveAll(dataDir)
+		return nil, fmt.Errorf("embedtor: failed to pick a ControlPort: %v", err)
+	}
+
+	cookiePath := filepath.Join(dataDir, cookieFileName)
+	torrc := fmt.Sprintf(
+		"DataDirectory %s\n"+
+			"ControlPort 127.0.0.1:%d\n"+
+			"CookieAuthentication 1\n"+
+			"CookieAuthFile %s\n"+
+			"SocksPort 0\n",
+		dataDir, ctrlPort, cookiePath)
+	torrcPath := filepath.Join(dataDir, torrcName)
+	if err = ioutil.WriteFile(torrcPath, []byte(torrc), 0600); err != nil {
+		os.RemoveAll(dataDir)
+		return nil, fmt.Errorf("embedtor: failed to write torrc: %v", err)
+	}
+
+	torPath := cfg.TorPath
+	if torPath == "" {
+		torPath = "tor"
+	}
+	cmd := exec.Command(torPath, "-f", torrcPath)
+
+	logR, logW, err := os.Pipe()
+	if err != nil {
+		os.RemoveAll(dataDir)
+		return nil, fmt.Errorf("embedtor: failed to create log pipe: %v", err)
+	}
+	cmd.Stdout = logW
+	cmd.Stderr = logW
+
+	if err = cmd.Start(); err != nil {
+		logR.Close()
+		logW.Close()
+		os.RemoveAll(dataDir)
+		return nil, fmt.Errorf("embedtor: failed to start '%s': %v", torPath, err)
+	}
+	logW.Close()
+
+	bootstrapped := make(chan error, 1)
+	go func() {
+		// Keep draining logR for as long as tor runs: it keeps logging
+		// long after bootstrap (circuit events, heartbeats, ...), and
+		// once nobody reads the pipe, tor's own writes to it block and
+		// the whole embedded process freezes.
+		reportedBootstrap := false
+		scanner := bufio.NewScanner(logR)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if cfg.Stderr != nil {
+				fmt.Fprintln(cfg.Stderr, line)
+			}
+			if !reportedBootstrap && strings.Contains(line, bootstrappedMarker) {
+				reportedBootstrap = true
+				bootstrapped <- nil
+			}
+		}
+		if !reportedBootstrap {
+			bootstrapped <- fmt.Errorf("tor exited before finishing bootstrap: %v", scanner.Err())
+		}
+	}()
+
+	timeout := cfg.BootstrapTimeout
+	if timeout <= 0 {
+		timeout = defaultBootstrapDur
+	}
+	select {
+	case err = <-bootstrapped:
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			os.RemoveAll(dataDir)
+			return nil, fmt.Errorf("embedtor: %v", err)
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dataDir)
+		return nil, errors.New("embedtor: timed out waiting for tor to bootstrap")
+	}
+
+	return &Tor{
+		cmd:        cmd,
+		dataDir:    dataDir,
+		ctrlNet:    "tcp",
+		ctrlAddr:   fmt.Sprintf("127.0.0.1:%d", ctrlPort),
+		cookiePath: cookiePath,
+	}, nil
+}
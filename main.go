@@ -9,11 +9,13 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"flag"
 	gofmt "fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -27,6 +29,8 @@ import (
 
 	"github.com/yawning/bulb"
 	"github.com/yawning/bulb/utils"
+
+	"github.com/Yawning/onionwrap/internal/embedtor"
 )
 
 const (
@@ -38,8 +42,15 @@ const (
 
 	sigKillDelay = 5 * time.Second
 
+	// hsDescFallbackDelay is how long to sleep in lieu of waiting for an
+	// 'HS_DESC' event, on Tor versions/configurations that don't emit one.
+	hsDescFallbackDelay = 10 * time.Second
+
 	onionKeyTypeRSA = "RSA1024"
 	pemKeyTypeRSA   = "RSA PRIVATE KEY"
+
+	onionKeyTypeV3 = "ED25519-V3"
+	pemKeyTypeV3   = "ED25519-V3 PRIVATE KEY"
 )
 
 var debugSpew bool
@@ -75,6 +86,26 @@ func parsePort(portStr string) (uint16, error) {
 	return uint16(p), nil
 }
 
+// portMapping is a single parsed '-port' argument.
+type portMapping struct {
+	virtPort   string
+	targetPort string
+	target     string
+}
+
+// portArgList is a repeatable '-port' flag, collected in the order given
+// on the command line.
+type portArgList []string
+
+func (p *portArgList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *portArgList) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
 func parsePortArg(arg string) (virtPort, targetPort, target string, err error) {
 	// This is formated as VIRTPORT[,TARGET], which is identical to
 	// what the ADD_ONION command expects out of the 'Port' arguments.
@@ -119,6 +150,23 @@ func parsePortArg(arg string) (virtPort, targetPort, target string, err error) {
 	return
 }
 
+// onionVersionToNewArg maps a '-onion-version' argument to the keyword
+// that is passed to 'ADD_ONION' in place of a serialized key, when a new
+// Onion Service is being created.
+var onionVersionToNewArg = map[string]string{
+	"2":    "NEW:RSA1024",
+	"3":    "NEW:ED25519-V3",
+	"best": "NEW:BEST",
+}
+
+// onionVersionToKeyType maps a '-onion-version' argument to the private
+// key type that a loaded key must have.  There is intentionally no entry
+// for "best", since that means the caller doesn't care.
+var onionVersionToKeyType = map[string]string{
+	"2": onionKeyTypeRSA,
+	"3": onionKeyTypeV3,
+}
+
 func loadPrivateKey(path string) (string, error) {
 	rawFile, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -131,8 +179,11 @@ func loadPrivateKey(path string) (string, error) {
 		if p == nil {
 			break
 		}
-		if p.Type == pemKeyTypeRSA {
+		switch p.Type {
+		case pemKeyTypeRSA:
 			return onionKeyTypeRSA + ":" + base64.StdEncoding.EncodeToString(p.Bytes), nil
+		case pemKeyTypeV3:
+			return onionKeyTypeV3 + ":" + base64.StdEncoding.EncodeToString(p.Bytes), nil
 		}
 	}
 	return "", errors.New("no valid PEM data found")
@@ -144,19 +195,112 @@ func savePrivateKey(path, keyStr string) (err error) {
 		return errors.New("failed to parse PrivateKey response")
 	}
 
-	var keyBlob []byte
+	var pemType string
 	switch splitKey[0] {
 	case onionKeyTypeRSA:
-		// Serialize into a standard RSA Private Key PEM file.
-		p := &pem.Block{Type: pemKeyTypeRSA}
-		if p.Bytes, err = base64.StdEncoding.DecodeString(splitKey[1]); err != nil {
-			return err
-		}
-		keyBlob = pem.EncodeToMemory(p)
+		pemType = pemKeyTypeRSA
+	case onionKeyTypeV3:
+		pemType = pemKeyTypeV3
 	default:
 		return errors.New("unknown key type: '" + splitKey[0] + "'")
 	}
-	return ioutil.WriteFile(path, keyBlob, 0600)
+
+	p := &pem.Block{Type: pemType}
+	if p.Bytes, err = base64.StdEncoding.DecodeString(splitKey[1]); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(p), 0600)
+}
+
+// waitHSDescPublished blocks until an 'HS_DESC UPLOADED'/'RECEIVED' event
+// naming serviceID arrives on eventChan, the control connection dies (as
+// signalled on doneChan), or timeout elapses.
+func waitHSDescPublished(eventChan <-chan *bulb.Response, doneChan <-chan error, serviceID string, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case ev := <-eventChan:
+			// A single-line '650 HS_DESC ...' event is carried entirely in
+			// the reply line, not in Data, so check both.
+			lines := append(append([]string{}, ev.Data...), ev.Reply)
+			for _, l := range lines {
+				fields := strings.Fields(l)
+				if len(fields) < 3 || fields[0] != "HS_DESC" {
+					continue
+				}
+				if (fields[1] == "UPLOADED" || fields[1] == "RECEIVED") && fields[2] == serviceID {
+					return nil
+				}
+			}
+		case err := <-doneChan:
+			return gofmt.Errorf("control connection closed while waiting for descriptor publication: %v", err)
+		case <-deadline.C:
+			return gofmt.Errorf("timed out after %v waiting for descriptor publication", timeout)
+		}
+	}
+}
+
+// torSupportsNonAnonymousHSDesc reports whether ctrlConn's tor is new
+// enough to emit 'HS_DESC' events for single onion ("-non-anonymous")
+// services.  Tor only started doing so in 0.4.0.1-alpha; older versions
+// never publish one, so waitHSDescPublished would just time out.
+func torSupportsNonAnonymousHSDesc(ctrlConn *bulb.Conn) bool {
+	resp, err := ctrlConn.Request("GETINFO version")
+	if err != nil || len(resp.Data) != 1 {
+		return false
+	}
+	versionStr := strings.TrimPrefix(resp.Data[0], "version=")
+	if fields := strings.Fields(versionStr); len(fields) > 0 {
+		versionStr = fields[0]
+	}
+	parts := strings.SplitN(versionStr, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	return major > 0 || minor >= 4
+}
+
+// buildOnionFlags assembles the 'Flags=' tokens for the 'ADD_ONION' request
+// that correspond to the relevant command line arguments.
+func buildOnionFlags(discardPK, detach, basicAuth, nonAnonymous, maxStreamsCloseCircuit bool) []string {
+	var flags []string
+	if discardPK {
+		flags = append(flags, "DiscardPK")
+	}
+	if detach {
+		flags = append(flags, "Detach")
+	}
+	if basicAuth {
+		flags = append(flags, "BasicAuth")
+	}
+	if nonAnonymous {
+		flags = append(flags, "NonAnonymous")
+	}
+	if maxStreamsCloseCircuit {
+		flags = append(flags, "MaxStreamsCloseCircuit")
+	}
+	return flags
+}
+
+// delOnion issues 'DEL_ONION' for serviceID, so that an ephemeral service
+// doesn't linger in the Tor process after onionwrap exits.  Failures are
+// logged, not fatal, since we're already on our way out.
+func delOnion(ctrlConn *bulb.Conn, serviceID string) {
+	if serviceID == "" {
+		return
+	}
+	if _, err := ctrlConn.Request("DEL_ONION %s", serviceID); err != nil {
+		infof("Failed to DEL_ONION %s: %v\n", serviceID, err)
+	}
 }
 
 func main() {
@@ -167,11 +311,28 @@ func main() {
 	const controlPortArg = "control-port"
 	ctrlPortArg := flag.String(controlPortArg, "", "Tor control port")
 	flag.Lookup(controlPortArg).DefValue = defaultControlPort
-	hsPortArg := flag.String("port", "", "Onion Service port")
+	var hsPortArgs portArgList
+	flag.Var(&hsPortArgs, "port", "Onion Service port (VIRTPORT[,TARGET]), may be repeated")
 	hsKeyArg := flag.String("onion-key", "", "Onion Service private key file")
+	onionVersionArg := flag.String("onion-version", "best", "Onion Service version to generate ('2', '3', or 'best')")
 	noRewriteArgs := flag.Bool("no-rewrite", false, "Disable rewriting subprocess arguments")
 	generatePK := flag.Bool("generate", false, "Generate and save a new key if needed")
 	inetd := flag.Bool("inetd", false, "Listen on the target port and fork/exec the comand per connection")
+	passFDArg := flag.Bool("pass-fd", false, "Expose the accepted socket as fd 3 instead of piping stdin/stdout (-inetd only)")
+	maxConnsArg := flag.Int("max-conns", 0, "Maximum concurrent -inetd connections (0 = unlimited)")
+	connTimeoutArg := flag.Duration("conn-timeout", 0, "Close idle -inetd connections after this long (0 = disabled)")
+	detachArg := flag.Bool("detach", false, "Leave the Onion Service running after onionwrap exits")
+	basicAuthArg := flag.Bool("basic-auth", false, "Require v2 BasicAuth for connecting clients")
+	nonAnonymousArg := flag.Bool("non-anonymous", false, "Create a single onion/non-anonymous Onion Service")
+	maxStreamsArg := flag.Int("max-streams", 0, "Maximum number of streams to allow on the service (0 = unlimited)")
+	maxStreamsCloseCircuitArg := flag.Bool("max-streams-close-circuit", false, "Close the circuit when the stream limit is reached")
+	publishTimeoutArg := flag.Duration("publish-timeout", 60*time.Second, "How long to wait for the Onion Service descriptor to publish")
+	var clientAuthArgs clientAuthArgList
+	flag.Var(&clientAuthArgs, "client-auth", "Client authorization NAME[:PUBKEY] (repeatable)")
+	clientAuthDirArg := flag.String("client-auth-dir", "", "Directory to write generated client '.auth_private' files to")
+	embedTorArg := flag.Bool("embed-tor", false, "Launch and manage a 'tor' process if the control port is unreachable")
+	torPathArg := flag.String("tor-path", "", "Path to the 'tor' binary, used with -embed-tor (default: $PATH)")
+	torBootstrapTimeoutArg := flag.Duration("tor-bootstrap-timeout", 60*time.Second, "How long to wait for an embedded 'tor' to bootstrap")
 	flag.BoolVar(&debugSpew, "debug", false, "Print debug messages to stderr")
 	flag.BoolVar(&quietSpew, "quiet", false, "Suppress non-error messages")
 	flag.Parse()
@@ -189,9 +350,55 @@ func main() {
 		errorf("Invalid control port: %v\n", err)
 	}
 
-	virtPort, targetPort, target, err := parsePortArg(*hsPortArg)
-	if err != nil {
-		errorf("Invalid virtual port: %v\n", err)
+	onionVersion := *onionVersionArg
+	if _, ok := onionVersionToNewArg[onionVersion]; !ok {
+		errorf("Invalid -onion-version: %q (must be '2', '3', or 'best')\n", onionVersion)
+	}
+
+	if *passFDArg && *connTimeoutArg > 0 {
+		errorf("Invalid flags: %v\n", errors.New("-conn-timeout has no effect with -pass-fd"))
+	}
+
+	if len(hsPortArgs) == 0 {
+		errorf("Invalid virtual port: %v\n", errors.New("no Onion Service port specified"))
+	}
+	hsMappings := make([]portMapping, 0, len(hsPortArgs))
+	for _, arg := range hsPortArgs {
+		virtPort, targetPort, target, err := parsePortArg(arg)
+		if err != nil {
+			errorf("Invalid virtual port '%s': %v\n", arg, err)
+		}
+		hsMappings = append(hsMappings, portMapping{virtPort, targetPort, target})
+	}
+
+	clientAuthEntries := make([]clientAuthEntry, 0, len(clientAuthArgs))
+	for _, arg := range clientAuthArgs {
+		e, err := parseClientAuthArg(arg)
+		if err != nil {
+			errorf("Invalid -client-auth '%s': %v\n", arg, err)
+		}
+		clientAuthEntries = append(clientAuthEntries, e)
+	}
+	// Any '-client-auth' entry without its own PUBKEY/cookie needs a key
+	// generated (v3) or assigned by Tor (v2) to be written to
+	// '-client-auth-dir' once the Onion Service is up.  Check that the
+	// directory is actually usable now, instead of discovering a bad
+	// '-client-auth-dir' only after the (by then un-deletable) ephemeral
+	// service has already been created on the control port.
+	for _, e := range clientAuthEntries {
+		if e.pubKey != "" {
+			continue
+		}
+		if *clientAuthDirArg == "" {
+			errorf("Invalid -client-auth-dir: %v\n", errors.New("must be set to save generated/assigned client credentials"))
+		}
+		f, err := ioutil.TempFile(*clientAuthDirArg, ".onionwrap-check-")
+		if err != nil {
+			errorf("Invalid -client-auth-dir '%s': %v\n", *clientAuthDirArg, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+		break
 	}
 
 	cmdVec := flag.Args()
@@ -212,17 +419,35 @@ func main() {
 		// subprocess command line arguments with values propagated from
 		// the onionwrap command line.
 		//
-		//  * %VPORT - The 'VIRTPORT'.
-		//  * %TPORT - The port component of 'TARGET'.
-		//  * %TADDR - The entire 'TARGET'.
+		//  * %VPORT<n> - The 'VIRTPORT' of the n-th '-port' mapping.
+		//  * %TPORT<n> - The port component of the n-th mapping's 'TARGET'.
+		//  * %TADDR<n> - The entire 'TARGET' of the n-th mapping.
+		//
+		// The unindexed %VPORT/%TPORT/%TADDR are aliases for the first
+		// ('-port' given first on the command line) mapping.  The indexed
+		// forms are substituted first, so that e.g. '%VPORT1' isn't
+		// mangled by the unindexed '%VPORT' substitution.  Indices are
+		// substituted highest-first, so that '%VPORT1' doesn't get
+		// partially matched and mangled inside '%VPORT10' before '%VPORT10'
+		// itself is reached.
 		for i := 1; i < len(cmd.Args); i++ {
 			v := cmd.Args[i]
-			v = strings.Replace(v, "%VPORT", virtPort, -1)
-			if targetPort != "" {
+			for n := len(hsMappings) - 1; n >= 0; n-- {
+				m := hsMappings[n]
+				idx := strconv.Itoa(n + 1)
+				v = strings.Replace(v, "%VPORT"+idx, m.virtPort, -1)
+				if m.targetPort != "" {
+					v = strings.Replace(v, "%TPORT"+idx, m.targetPort, -1)
+				}
+				v = strings.Replace(v, "%TADDR"+idx, m.target, -1)
+			}
+			first := hsMappings[0]
+			v = strings.Replace(v, "%VPORT", first.virtPort, -1)
+			if first.targetPort != "" {
 				// AF_UNIX targets won't have a port.
-				v = strings.Replace(v, "%TPORT", targetPort, -1)
+				v = strings.Replace(v, "%TPORT", first.targetPort, -1)
 			}
-			v = strings.Replace(v, "%TADDR", target, -1)
+			v = strings.Replace(v, "%TADDR", first.target, -1)
 			cmd.Args[i] = v
 		}
 	}
@@ -234,6 +459,11 @@ func main() {
 			if err != nil {
 				errorf("Failed to load Onion key: %v\n", err)
 			}
+			if wantType, ok := onionVersionToKeyType[onionVersion]; ok {
+				if keyType := strings.SplitN(hsKeyStr, ":", 2)[0]; keyType != wantType {
+					errorf("Onion key '%s' is %s, but -onion-version=%s requires %s\n", *hsKeyArg, keyType, onionVersion, wantType)
+				}
+			}
 		} else if os.IsNotExist(err) {
 			if !*generatePK {
 				errorf("Onion Key does not exist: %v\n", *hsKeyArg)
@@ -246,16 +476,55 @@ func main() {
 
 	debugf("Cmd: %v\n", cmd.Args)
 	debugf("CtrlPort: %v, %v\n", ctrlNet, ctrlAddr)
-	debugf("VirtPort: %v Target: %v\n", virtPort, target)
+	for n, m := range hsMappings {
+		debugf("VirtPort[%d]: %v Target[%d]: %v\n", n+1, m.virtPort, n+1, m.target)
+	}
 
 	//
 	// Do the actual work.
 	//
 
-	// Connect/authenticate with the control port.
+	// Connect/authenticate with the control port, launching our own 'tor'
+	// if one isn't reachable and '-embed-tor' was given.
+	var embeddedTor *embedtor.Tor
 	ctrlConn, err := bulb.Dial(ctrlNet, ctrlAddr)
+
+	// shutdownEmbeddedTor tears down the tor launched for '-embed-tor',
+	// if any. Every exit out of main() goes through os.Exit (directly,
+	// or via errorf/fatalf), which skips deferred calls entirely, so
+	// this has to be invoked explicitly at each exit point instead.
+	shutdownEmbeddedTor := func() {
+		if embeddedTor != nil {
+			embeddedTor.Shutdown(ctrlConn, sigKillDelay)
+		}
+	}
+	// fatalf is errorf that also reaps the embedded tor first, so it
+	// never leaks an orphaned process/data directory on a hard exit.
+	fatalf := func(fmtStr string, args ...interface{}) {
+		shutdownEmbeddedTor()
+		errorf(fmtStr, args...)
+	}
+
 	if err != nil {
-		errorf("Failed to connect to the control port: %v\n", err)
+		if !*embedTorArg {
+			fatalf("Failed to connect to the control port: %v\n", err)
+		}
+		infof("Control port unreachable (%v), launching an embedded tor\n", err)
+		var torStderr io.Writer
+		if debugSpew {
+			torStderr = os.Stderr
+		}
+		if embeddedTor, err = embedtor.Launch(embedtor.Config{
+			TorPath:          *torPathArg,
+			BootstrapTimeout: *torBootstrapTimeoutArg,
+			Stderr:           torStderr,
+		}); err != nil {
+			fatalf("Failed to launch embedded tor: %v\n", err)
+		}
+		ctrlNet, ctrlAddr = embeddedTor.ControlAddr()
+		if ctrlConn, err = bulb.Dial(ctrlNet, ctrlAddr); err != nil {
+			fatalf("Failed to connect to the embedded tor's control port: %v\n", err)
+		}
 	}
 	defer ctrlConn.Close()
 	if debugSpew {
@@ -263,104 +532,242 @@ func main() {
 		ctrlConn.Debug(debugSpew)
 	}
 	if err = ctrlConn.Authenticate(os.Getenv(controlPortPasswdEnv)); err != nil {
-		errorf("Failed to authenticate with the control port: %v\n", err)
+		fatalf("Failed to authenticate with the control port: %v\n", err)
+	}
+
+	// Figure out whether the service being created/loaded is v2 or v3, to
+	// decide how '-client-auth' should be wired up; an existing key's
+	// on-disk type wins, otherwise go by '-onion-version' ("best" is
+	// treated as v3, since that's what a modern Tor will hand back).
+	clientAuthIsV2 := onionVersion == "2"
+	if hsKeyStr != "" {
+		clientAuthIsV2 = strings.HasPrefix(hsKeyStr, onionKeyTypeRSA+":")
+	}
+
+	// Build the 'ClientAuthV3='/'ClientAuth=' clauses, generating keys for
+	// any '-client-auth' entry that didn't supply its own PUBKEY/cookie.
+	// Generated v3 private keys and Tor-assigned v2 cookies can't be
+	// written out until the ServiceID is known, so stash what's needed.
+	var clientAuthClauses []string
+	var pendingV3Writes []pendingV3ClientAuthWrite
+	var pendingV2Names []string
+	for _, e := range clientAuthEntries {
+		if clientAuthIsV2 {
+			if e.pubKey != "" {
+				clientAuthClauses = append(clientAuthClauses, "ClientAuth="+e.name+":"+e.pubKey)
+			} else {
+				clientAuthClauses = append(clientAuthClauses, "ClientAuth="+e.name)
+				pendingV2Names = append(pendingV2Names, e.name)
+			}
+			continue
+		}
+
+		pubKey := e.pubKey
+		if pubKey == "" {
+			pub, priv, err := generateV3ClientAuthKey()
+			if err != nil {
+				fatalf("Failed to generate client authorization key for '%s': %v\n", e.name, err)
+			}
+			pubKey = base32NoPad(pub[:])
+			pendingV3Writes = append(pendingV3Writes, pendingV3ClientAuthWrite{e.name, priv})
+		}
+		clientAuthClauses = append(clientAuthClauses, "ClientAuthV3="+pubKey)
+	}
+	if len(clientAuthEntries) > 0 && clientAuthIsV2 {
+		*basicAuthArg = true
+	}
+
+	// Assemble the 'Flags=' and other optional clauses for 'ADD_ONION'.
+	onionFlags := buildOnionFlags(hsKeyStr == "" && !*generatePK, *detachArg, *basicAuthArg, *nonAnonymousArg, *maxStreamsCloseCircuitArg)
+	var extraArgs string
+	if len(onionFlags) > 0 {
+		extraArgs += " Flags=" + strings.Join(onionFlags, ",")
+	}
+	if *maxStreamsArg > 0 {
+		extraArgs += gofmt.Sprintf(" MaxStreams=%d", *maxStreamsArg)
+	}
+	for _, c := range clientAuthClauses {
+		extraArgs += " " + c
+	}
+
+	// Build one 'Port=' clause per '-port' mapping; Tor accepts repeated
+	// 'Port=' arguments in a single 'ADD_ONION' request.
+	portClauses := make([]string, 0, len(hsPortArgs))
+	for _, p := range hsPortArgs {
+		portClauses = append(portClauses, "Port="+p)
 	}
+	portArgs := strings.Join(portClauses, " ")
 
 	// Initialize the Onion Service.
 	var resp *bulb.Response
 	if hsKeyStr == "" {
-		flags := " Flags=DiscardPK"
-		if *generatePK {
-			flags = ""
-		}
-		resp, err = ctrlConn.Request("ADD_ONION NEW:BEST Port=%s%s", *hsPortArg, flags)
+		resp, err = ctrlConn.Request("ADD_ONION %s %s%s", onionVersionToNewArg[onionVersion], portArgs, extraArgs)
 	} else {
-		resp, err = ctrlConn.Request("ADD_ONION %s Port=%s", hsKeyStr, *hsPortArg)
+		resp, err = ctrlConn.Request("ADD_ONION %s %s%s", hsKeyStr, portArgs, extraArgs)
 	}
 	if err != nil {
-		errorf("Failed to create onion service: %v\n", err)
+		fatalf("Failed to create onion service: %v\n", err)
 	}
 	var serviceID string
+	v2Cookies := make(map[string]string)
 	for _, l := range resp.Data {
 		const (
 			serviceIDPrefix  = "ServiceID="
 			privateKeyPrefix = "PrivateKey="
+			clientAuthPrefix = "ClientAuth="
 		)
 
 		if strings.HasPrefix(l, serviceIDPrefix) {
 			serviceID = strings.TrimPrefix(l, serviceIDPrefix)
 		} else if strings.HasPrefix(l, privateKeyPrefix) {
 			if !*generatePK || hsKeyStr != "" {
-				errorf("Received a private key when we shouldn't have.\n")
+				fatalf("Received a private key when we shouldn't have.\n")
 			}
 			hsKeyStr = strings.TrimPrefix(l, privateKeyPrefix)
 			if err = savePrivateKey(*hsKeyArg, hsKeyStr); err != nil {
-				errorf("Failed to save private key: %v\n", err)
+				fatalf("Failed to save private key: %v\n", err)
+			}
+		} else if strings.HasPrefix(l, clientAuthPrefix) {
+			nameCookie := strings.SplitN(strings.TrimPrefix(l, clientAuthPrefix), ":", 2)
+			if len(nameCookie) == 2 {
+				v2Cookies[nameCookie[0]] = nameCookie[1]
 			}
 		}
 	}
+	for _, w := range pendingV3Writes {
+		if err = writeV3ClientAuthFile(*clientAuthDirArg, w.name, serviceID, w.privKey); err != nil {
+			fatalf("Failed to save client authorization key for '%s': %v\n", w.name, err)
+		}
+	}
+	for _, name := range pendingV2Names {
+		cookie, ok := v2Cookies[name]
+		if !ok {
+			fatalf("Tor did not return a BasicAuth cookie for client '%s'\n", name)
+		}
+		if err = writeV2ClientAuthFile(*clientAuthDirArg, name, cookie); err != nil {
+			fatalf("Failed to save client authorization cookie for '%s': %v\n", name, err)
+		}
+	}
 	if serviceID == "" {
 		// This should *NEVER* happen since the command succeded, and
 		// the spec guarantees that this will be sent.
-		errorf("Failed to determine service ID.")
+		fatalf("Failed to determine service ID.")
+	}
+	for _, m := range hsMappings {
+		infof("Created onion: %s.onion:%s -> %s\n", serviceID, m.virtPort, m.target)
 	}
-	infof("Created onion: %s.onion:%s -> %s\n", serviceID, virtPort, target)
 
-	// TODO: Wait till the HS descriptor has been published?
+	// Subscribe to 'HS_DESC' events so that we can tell when the
+	// descriptor has actually been published, before handing off to the
+	// wrapped command.
+	if _, err = ctrlConn.Request("SETEVENTS HS_DESC"); err != nil {
+		fatalf("Failed to subscribe to HS_DESC events: %v\n", err)
+	}
 	ctrlConn.StartAsyncReader()
+	eventChan := make(chan *bulb.Response)
 	doneChan = make(chan error)
 	go func() {
 		for {
-			if _, err := ctrlConn.NextEvent(); err != nil {
+			ev, err := ctrlConn.NextEvent()
+			if err != nil {
 				doneChan <- err
 				return
 			}
+			eventChan <- ev
+		}
+	}()
+
+	if *nonAnonymousArg && !torSupportsNonAnonymousHSDesc(ctrlConn) {
+		// Single Onion Services running on older Tor don't emit
+		// 'HS_DESC' events, so there's nothing productive to wait on.
+		infof("Single Onion Service: tor is too old to emit HS_DESC for it, sleeping %v instead\n", hsDescFallbackDelay)
+		time.Sleep(hsDescFallbackDelay)
+	} else if err = waitHSDescPublished(eventChan, doneChan, serviceID, *publishTimeoutArg); err != nil {
+		fatalf("Failed to wait for descriptor publication: %v\n", err)
+	} else {
+		infof("Onion Service descriptor published.\n")
+	}
+
+	// waitHSDescPublished only reads eventChan until the first matching
+	// event; Tor keeps sending 'HS_DESC' on every republish for as long
+	// as the control connection is up, and with nothing left to read
+	// eventChan the goroutine above blocks forever trying to deliver
+	// the next one. That backs up into bulb's own event buffer and then
+	// wedges its single asyncReader, taking every later control request
+	// (including the shutdown-time 'DEL_ONION') down with it. Keep
+	// draining and discarding events for as long as the process runs.
+	go func() {
+		for range eventChan {
 		}
 	}()
 
+	// Set up a context that's cancelled on SIGINT/SIGTERM, so that both
+	// the '-inetd' and regular code paths can shut down cleanly instead
+	// of relying on the control connection dropping.
+	ctx, cancel := context.WithCancel(context.Background())
+	var receivedSig os.Signal
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		receivedSig = <-sigChan
+		debugf("received signal: %v\n", receivedSig)
+		cancel()
+	}()
+
 	if *inetd {
-		targetNet := "tcp"
-		if targetPort == "" {
-			targetNet = "unix"
+		specs := make([]listenerSpec, 0, len(hsMappings))
+		for _, m := range hsMappings {
+			network := "tcp"
+			if m.targetPort == "" {
+				network = "unix"
+			}
+			specs = append(specs, listenerSpec{network: network, address: m.target, virtPort: m.virtPort})
+		}
+		runInetd(ctx, specs, cmd, serviceID, *maxConnsArg, *connTimeoutArg, *passFDArg)
+		if !*detachArg {
+			delOnion(ctrlConn, serviceID)
+			shutdownEmbeddedTor()
 		}
-		runInetd(targetNet, target, cmd)
 		os.Exit(0)
 	}
 
-	// Initialize the signal handling and launch the process.
-	sigChan := make(chan os.Signal)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	err = cmd.Start()
-	if err != nil {
+	// Launch the wrapped process.
+	if err = cmd.Start(); err != nil {
+		if !*detachArg {
+			delOnion(ctrlConn, serviceID)
+			shutdownEmbeddedTor()
+		}
 		os.Exit(-1)
 	}
+	// cmd.Wait()'s completion gets its own channel: doneChan is also fed
+	// by the control connection's event reader for as long as the child
+	// runs (the connection has to stay open for the whole session), and
+	// treating that as "the child exited" would tear down the onion out
+	// from under a still-running child and report a bogus exit code.
+	childDoneChan := make(chan error)
 	go func() {
-		doneChan <- cmd.Wait()
+		childDoneChan <- cmd.Wait()
 	}()
 
 	// Wait for the child to finish, or a signal to arrive.
 	select {
-	case <-doneChan:
-	case sig := <-sigChan:
+	case <-childDoneChan:
+	case <-ctx.Done():
 		// Propagate the signal to the child, and wait for it to die.
-		debugf("received signal: %v\n", sig)
-		cmd.Process.Signal(sig)
+		cmd.Process.Signal(receivedSig)
 		select {
-		case <-doneChan:
+		case <-childDoneChan:
 		case <-time.After(sigKillDelay):
 			debugf("post signal delay elapsed, killing child\n")
 			cmd.Process.Kill()
-			os.Exit(-1)
+			<-childDoneChan
 		}
 	}
 
-	// Ensure that it's really dead.
-	cmd.Process.Kill()
-
 	debugf("child process terminated\n")
-	if cmd.ProcessState == nil || !cmd.ProcessState.Success() {
-		// ProcessState doesn't give the exact return value. :(
-		os.Exit(-1)
+	if !*detachArg {
+		delOnion(ctrlConn, serviceID)
+		shutdownEmbeddedTor()
 	}
-	os.Exit(0)
+	os.Exit(cmd.ProcessState.ExitCode())
 }